@@ -1,3 +1,4 @@
+//go:build darwin
 // +build darwin
 
 /*
@@ -21,8 +22,11 @@ package hyperkit
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -39,9 +43,22 @@ import (
 )
 
 const (
-	isoFilename     = "boot2docker.iso"
-	pidFileName     = "hyperkit.pid"
-	machineFileName = "hyperkit.json"
+	isoFilename      = "boot2docker.iso"
+	pidFileName      = "hyperkit.pid"
+	machineFileName  = "hyperkit.json"
+	driverConfigFile = "driver.json"
+
+	defaultCPUs          = 1
+	defaultMemory        = 1024
+	defaultDiskSize      = 20000
+	defaultNFSSharesRoot = "/Users"
+
+	// driverConfigVersion is bumped whenever the on-disk shape of Driver
+	// changes in a way that needs migrating in loadConfig.
+	driverConfigVersion = 1
+
+	isoDownloadRetries       = 3
+	isoDownloadRetryInterval = 5 * time.Second
 )
 
 type Driver struct {
@@ -51,6 +68,35 @@ type Driver struct {
 	CPU            int
 	Memory         int
 	Cmdline        string
+
+	// ISOChecksum is the expected SHA256 checksum of the boot2docker ISO.
+	// When empty, it is fetched from Boot2DockerURL instead.
+	ISOChecksum string
+
+	// UUID is used to generate a consistent MAC address across reboots, rather
+	// than a fresh one being assigned every Start().
+	UUID string
+
+	// VpnKitSock is the path to the VPNKit socket used for networking
+	// through Docker for Mac. The special value "auto" resolves to the
+	// Docker for Mac VPNKit socket. An empty value disables VPNKit.
+	VpnKitSock string
+
+	// VSockPorts is a list of guest VSock ports that should be exposed
+	// as sockets on the host.
+	VSockPorts []string
+
+	// NFSShare enables sharing of NFSSharesRoot between the host and the VM.
+	NFSShare bool
+
+	// NFSSharesRoot is the host path exported via NFS to the VM when
+	// NFSShare is enabled.
+	NFSSharesRoot string
+
+	// ConfigVersion is the schema version of this struct as last persisted
+	// to driver.json. loadConfig reads it back and logs a warning for a
+	// version it does not recognize; no migrations exist yet.
+	ConfigVersion int
 }
 
 func NewDriver(hostName, storePath string) *Driver {
@@ -58,6 +104,11 @@ func NewDriver(hostName, storePath string) *Driver {
 		BaseDriver: &drivers.BaseDriver{
 			SSHUser: "docker",
 		},
+		CPU:           defaultCPUs,
+		Memory:        defaultMemory,
+		DiskSize:      defaultDiskSize,
+		NFSSharesRoot: defaultNFSSharesRoot,
+		ConfigVersion: driverConfigVersion,
 	}
 }
 
@@ -68,11 +119,45 @@ func (d *Driver) Create() error {
 		return err
 	}
 
-	if err := b2dutils.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName); err != nil {
-		return err
-	}
 	isoPath := d.ResolveStorePath(isoFilename)
-	if err := d.extractKernel(isoPath); err != nil {
+	isoCachePath := filepath.Join(d.StorePath, "cache", isoFilename)
+
+	downloadISO := func() error {
+		if err := b2dutils.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName); err != nil {
+			// CopyIsoToMachineDir downloads into the shared cache dir before
+			// copying into the machine dir; that's the file a prior `sudo
+			// minikube start` can leave root-owned and unwritable.
+			if chownErr := fixCacheOwnership(isoCachePath); chownErr != nil {
+				log.Warnf("Unable to fix ownership of %s: %v", isoCachePath, chownErr)
+			}
+			return &commonutil.RetriableError{Err: err}
+		}
+		if err := d.verifyISOChecksum(isoPath); err != nil {
+			// The cached copy is corrupt. CopyIsoToMachineDir skips
+			// re-downloading a file that already exists, so without removing
+			// both copies here every retry would just re-validate the same
+			// bad bytes.
+			os.Remove(isoPath)
+			os.Remove(isoCachePath)
+			return &commonutil.RetriableError{Err: err}
+		}
+		return nil
+	}
+	if err := commonutil.RetryAfter(isoDownloadRetries, downloadISO, isoDownloadRetryInterval); err != nil {
+		return fmt.Errorf("unable to download boot2docker iso: %v", err)
+	}
+
+	extractKernel := func() error {
+		if err := d.extractKernel(isoPath); err != nil {
+			return &commonutil.RetriableError{Err: err}
+		}
+		return nil
+	}
+	if err := commonutil.RetryAfter(isoDownloadRetries, extractKernel, isoDownloadRetryInterval); err != nil {
+		return fmt.Errorf("unable to extract kernel from boot2docker iso: %v", err)
+	}
+
+	if err := d.saveConfig(); err != nil {
 		return err
 	}
 
@@ -87,7 +172,67 @@ func (d *Driver) DriverName() string {
 // GetCreateFlags returns the mcnflag.Flag slice representing the flags
 // that can be set, their descriptions and defaults.
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
-	return nil
+	return []mcnflag.Flag{
+		mcnflag.StringFlag{
+			EnvVar: "HYPERKIT_BOOT2DOCKER_URL",
+			Name:   "hyperkit-boot2docker-url",
+			Usage:  "The URL of the boot2docker image. Defaults to the latest available version",
+			Value:  "",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HYPERKIT_CPU_COUNT",
+			Name:   "hyperkit-cpu-count",
+			Usage:  "Number of CPUs for the machine (-1 to use the number of CPUs available)",
+			Value:  defaultCPUs,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HYPERKIT_MEMORY_SIZE",
+			Name:   "hyperkit-memory",
+			Usage:  "Size of memory for the machine in MB",
+			Value:  defaultMemory,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "HYPERKIT_DISK_SIZE",
+			Name:   "hyperkit-disk-size",
+			Usage:  "Size of disk for the machine in MB",
+			Value:  defaultDiskSize,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "HYPERKIT_CMDLINE",
+			Name:   "hyperkit-cmdline",
+			Usage:  "Custom kernel boot cmdline",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "HYPERKIT_ISO_CHECKSUM",
+			Name:   "hyperkit-iso-checksum",
+			Usage:  "SHA256 checksum to verify the boot2docker ISO against. Defaults to fetching it from --hyperkit-boot2docker-url",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "HYPERKIT_VPNKIT_SOCK",
+			Name:   "hyperkit-vpnkit-sock",
+			Usage:  "Location of the VPNKit socket used for networking. Use 'auto' to use the Docker for Mac VPNKit connection, empty to disable",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "HYPERKIT_VSOCK_PORTS",
+			Name:   "hyperkit-vsock-ports",
+			Usage:  "List of guest VSock ports that should be exposed as sockets on the host",
+			Value:  []string{},
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "HYPERKIT_NFS_SHARE",
+			Name:   "hyperkit-nfs-share",
+			Usage:  "Setup an NFS share for the VM to the specified --hyperkit-nfs-shares-root",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "HYPERKIT_NFS_SHARES_ROOT",
+			Name:   "hyperkit-nfs-shares-root",
+			Usage:  "Where to root the NFS Shares, defaults to /Users",
+			Value:  defaultNFSSharesRoot,
+		},
+	}
 }
 
 // GetSSHHostname returns hostname for use with ssh
@@ -107,6 +252,10 @@ func (d *Driver) GetURL() (string, error) {
 
 // GetState returns the state that the host is in (running, stopped, etc)
 func (d *Driver) GetState() (state.State, error) {
+	if err := d.loadConfig(); err != nil {
+		return state.Error, err
+	}
+
 	pid := d.getPid()
 	if pid == 0 {
 		return state.Stopped, nil
@@ -138,6 +287,10 @@ func (d *Driver) PreCreateCheck() error {
 
 // Remove a host
 func (d *Driver) Remove() error {
+	if err := d.loadConfig(); err != nil {
+		return err
+	}
+
 	s, err := d.GetState()
 	if err != nil || s == state.Error {
 		log.Infof("Error checking machine status: %s, assuming it has been removed already", err)
@@ -147,6 +300,11 @@ func (d *Driver) Remove() error {
 			return err
 		}
 	}
+	if d.NFSShare {
+		if err := d.removeNFSShare(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -164,11 +322,28 @@ func (d *Driver) Restart() error {
 // SetConfigFromFlags configures the driver with the object that was returned
 // by RegisterCreateFlags
 func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
+	d.Boot2DockerURL = opts.String("hyperkit-boot2docker-url")
+	d.CPU = opts.Int("hyperkit-cpu-count")
+	d.Memory = opts.Int("hyperkit-memory")
+	d.DiskSize = opts.Int("hyperkit-disk-size")
+	d.Cmdline = opts.String("hyperkit-cmdline")
+	d.ISOChecksum = opts.String("hyperkit-iso-checksum")
+	d.VpnKitSock = opts.String("hyperkit-vpnkit-sock")
+	d.VSockPorts = opts.StringSlice("hyperkit-vsock-ports")
+	d.NFSShare = opts.Bool("hyperkit-nfs-share")
+	d.NFSSharesRoot = opts.String("hyperkit-nfs-shares-root")
+
+	d.SSHUser = "docker"
+	d.SSHPort = 22
+
 	return nil
 }
 
 // Start a host
 func (d *Driver) Start() error {
+	if err := d.loadConfig(); err != nil {
+		return err
+	}
 
 	// TODO: handle different disk types.
 	diskPath := filepath.Join(d.ResolveStorePath("."), d.MachineName+".rawdisk")
@@ -189,15 +364,37 @@ func (d *Driver) Start() error {
 	// TODO: handle the rest of our settings.
 	h.Kernel = d.ResolveStorePath("bzimage")
 	h.Initrd = d.ResolveStorePath("initrd")
-	h.VMNet = true
 	h.ISOImage = d.ResolveStorePath(isoFilename)
 	h.Console = hyperkit.ConsoleFile
 	h.CPUs = d.CPU
+	if h.CPUs == -1 {
+		h.CPUs = runtime.NumCPU()
+	}
 	h.Memory = d.Memory
 
-	// Set UUID
-	h.UUID = uuid.NewUUID().String()
-	log.Infof("Generated UUID %s", h.UUID)
+	if d.VpnKitSock != "" {
+		vpnkitSock, err := d.resolveVPNKitSock()
+		if err != nil {
+			return err
+		}
+		h.VPNKitSock = vpnkitSock
+	} else {
+		h.VMNet = true
+	}
+
+	if len(d.VSockPorts) > 0 {
+		h.VSock = true
+		h.VSockPorts, err = d.parseVSockPorts()
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.UUID == "" {
+		d.UUID = uuid.NewUUID().String()
+	}
+	h.UUID = d.UUID
+	log.Infof("Using UUID %s", h.UUID)
 	mac, err := vmnet.GetMACAddressFromUUID(h.UUID)
 	if err != nil {
 		return err
@@ -231,11 +428,21 @@ func (d *Driver) Start() error {
 	if err := commonutil.RetryAfter(30, getIP, 2*time.Second); err != nil {
 		return fmt.Errorf("IP address never found in dhcp leases file %v", err)
 	}
-	return nil
+
+	if d.NFSShare {
+		if err := d.setupNFSShare(); err != nil {
+			return fmt.Errorf("setting up NFS share: %v", err)
+		}
+	}
+
+	return d.saveConfig()
 }
 
 // Stop a host gracefully
 func (d *Driver) Stop() error {
+	if err := d.loadConfig(); err != nil {
+		return err
+	}
 	return d.sendSignal(syscall.SIGTERM)
 }
 
@@ -260,6 +467,41 @@ func (d *Driver) publicSSHKeyPath() string {
 	return d.GetSSHKeyPath() + ".pub"
 }
 
+// resolveVPNKitSock returns the path to the VPNKit socket that hyperkit
+// should connect to, resolving the special "auto" value to the Docker for
+// Mac VPNKit socket.
+func (d *Driver) resolveVPNKitSock() (string, error) {
+	if d.VpnKitSock != "auto" {
+		return d.VpnKitSock, nil
+	}
+
+	home := os.Getenv("HOME")
+	for _, candidate := range []string{
+		filepath.Join(home, "Library/Containers/com.docker.docker/Data/s50"),
+		filepath.Join(home, "Library/Containers/com.docker.docker/Data/vpnkit.eth.sock"),
+	} {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("unable to locate Docker for Mac VPNKit socket")
+}
+
+// parseVSockPorts parses the configured VSockPorts into ints, as required
+// by the hyperkit.HyperKit VSockPorts field.
+func (d *Driver) parseVSockPorts() ([]int, error) {
+	ports := make([]int, 0, len(d.VSockPorts))
+	for _, p := range d.VSockPorts {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("vsock port '%s' is not an integer: %v", p, err)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
 func (d *Driver) sendSignal(s os.Signal) error {
 	pid := d.getPid()
 	proc, err := os.FindProcess(pid)
@@ -287,3 +529,60 @@ func (d *Driver) getPid() int {
 
 	return config.Pid
 }
+
+// saveConfig persists the driver's configurable fields to driver.json in
+// the machine directory, so they survive a process restart.
+func (d *Driver) saveConfig() error {
+	d.ConfigVersion = driverConfigVersion
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(d.ResolveStorePath(driverConfigFile), data, 0644)
+}
+
+// loadConfig reloads the driver's configurable fields from driver.json, if
+// it exists, leaving d untouched when no config has been saved yet. Fields
+// managed by drivers.BaseDriver (MachineName, StorePath, ...) are never
+// overwritten.
+func (d *Driver) loadConfig() error {
+	path := d.ResolveStorePath(driverConfigFile)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved Driver
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	// No migrations are needed yet; saved.ConfigVersion is checked here so
+	// future schema changes have a place to branch on it.
+	switch saved.ConfigVersion {
+	case driverConfigVersion:
+	default:
+		log.Warnf("%s has unrecognized config version %d, using as-is", path, saved.ConfigVersion)
+	}
+
+	d.Boot2DockerURL = saved.Boot2DockerURL
+	d.DiskSize = saved.DiskSize
+	d.CPU = saved.CPU
+	d.Memory = saved.Memory
+	d.Cmdline = saved.Cmdline
+	d.ISOChecksum = saved.ISOChecksum
+	d.UUID = saved.UUID
+	d.VpnKitSock = saved.VpnKitSock
+	d.VSockPorts = saved.VSockPorts
+	d.NFSShare = saved.NFSShare
+	d.NFSSharesRoot = saved.NFSSharesRoot
+	d.ConfigVersion = saved.ConfigVersion
+
+	return nil
+}
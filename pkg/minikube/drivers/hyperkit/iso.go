@@ -0,0 +1,138 @@
+//go:build darwin
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// verifyISOChecksum confirms that isoPath's SHA256 matches d.ISOChecksum, or
+// the checksum published alongside d.Boot2DockerURL when ISOChecksum isn't
+// set. A release URL that doesn't publish a checksum is not treated as an
+// error, since not every Boot2DockerURL is expected to have one.
+func (d *Driver) verifyISOChecksum(isoPath string) error {
+	want := d.ISOChecksum
+	if want == "" {
+		var err error
+		want, err = fetchISOChecksum(d.Boot2DockerURL)
+		if err != nil {
+			log.Warnf("Unable to fetch boot2docker ISO checksum, skipping verification: %v", err)
+			return nil
+		}
+		if want == "" {
+			return nil
+		}
+	}
+
+	got, err := fileSHA256(isoPath)
+	if err != nil {
+		return fmt.Errorf("checksumming %s: %v", isoPath, err)
+	}
+
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("boot2docker ISO checksum mismatch: got %s, expected %s", got, want)
+	}
+
+	return nil
+}
+
+// fetchISOChecksum downloads the "<isoURL>.sha256" file published alongside
+// boot2docker releases. An empty result with a nil error means no checksum
+// is published for this URL.
+func fetchISOChecksum(isoURL string) (string, error) {
+	if isoURL == "" {
+		return "", nil
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(isoURL + ".sha256")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	return fields[0], nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// fixCacheOwnership chowns path back to the invoking user when minikube is
+// running under sudo, covering the case where CopyIsoToMachineDir leaves
+// behind a root-owned cache file that a later, unprivileged retry can't
+// overwrite.
+func fixCacheOwnership(path string) error {
+	uidStr := os.Getenv("SUDO_UID")
+	gidStr := os.Getenv("SUDO_GID")
+	if uidStr == "" || gidStr == "" {
+		return nil
+	}
+
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,64 @@
+//go:build darwin
+// +build darwin
+
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hyperkit
+
+import (
+	"fmt"
+	"os/user"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/johanneswuerbach/nfsexports"
+)
+
+// nfsExportIdentifier uniquely tags this machine's entry in /etc/exports so
+// it can be found and removed again without touching exports added by hand
+// or by other machines.
+func (d *Driver) nfsExportIdentifier() string {
+	return fmt.Sprintf("minikube-%s", d.MachineName)
+}
+
+// setupNFSShare adds an entry to /etc/exports granting the VM access to
+// NFSSharesRoot and reloads nfsd so the change takes effect immediately.
+func (d *Driver) setupNFSShare() error {
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("looking up current user: %v", err)
+	}
+
+	line := fmt.Sprintf("%s -alldirs -mapall=%s:%s %s", d.NFSSharesRoot, u.Uid, u.Gid, d.IPAddress)
+
+	log.Infof("Adding NFS share: %s", line)
+	if err := nfsexports.Add("", d.nfsExportIdentifier(), line); err != nil {
+		return fmt.Errorf("adding NFS share: %v", err)
+	}
+
+	return nfsexports.ReloadDaemon()
+}
+
+// removeNFSShare removes this machine's entry from /etc/exports, if present,
+// and reloads nfsd.
+func (d *Driver) removeNFSShare() error {
+	log.Infof("Removing NFS share")
+	if err := nfsexports.Remove("", d.nfsExportIdentifier()); err != nil {
+		return fmt.Errorf("removing NFS share: %v", err)
+	}
+
+	return nfsexports.ReloadDaemon()
+}